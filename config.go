@@ -0,0 +1,183 @@
+// SPDX-FileCopyrightText: 2018 - 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const configFile = "/boot/deepin-ab-recovery.json"
+
+// Config 保存备份/还原所需要的全部状态，随备份动作一起持久化到 configFile 中。
+type Config struct {
+	Current string
+	Backup  string
+	Time    *time.Time
+	Version string
+
+	// Schedule 描述自动备份的定时策略。
+	Schedule *Schedule `json:",omitempty"`
+
+	// HookTimeout 限定每个 hooks.d 脚本的最长执行时间，0 表示不限制。
+	HookTimeout time.Duration `json:",omitempty"`
+
+	// Retention 控制保留多少代快照，开启后 startBackup 不再覆盖唯一的备份分区，
+	// 而是在覆盖前对其打一个只读快照。
+	Retention Retention `json:",omitempty"`
+
+	// Encryption 控制是否用 LUKS2 加密备份分区的内容。
+	Encryption Encryption `json:",omitempty"`
+}
+
+// Encryption 描述备份分区的加密方式，被窃的磁盘不应该能直接读出系统快照。
+type Encryption struct {
+	Enabled bool
+	// KeyFile 存放解锁口令的文件路径；留空时必须通过 Unlock 在运行时提供口令。
+	KeyFile string
+	// Cipher 传给 cryptsetup luksFormat --cipher，留空使用 cryptsetup 的默认值。
+	Cipher string
+}
+
+// Retention 镜像了 offen/docker-volume-backup 里 retentionDays/pruningPrefix 的思路：
+// 按代数和按时间两种策略取交集共同生效，但无论如何都至少保留一代。
+type Retention struct {
+	// Count 是要保留的快照数量上限，<= 0 表示不按数量限制。
+	Count int
+	// MaxAge 是快照允许存在的最长时间，<= 0 表示不按时间限制。
+	MaxAge time.Duration
+	// Prefix 是快照子卷/逻辑卷名称的前缀，用来和其他子卷区分开。
+	Prefix string
+}
+
+// clone 深拷贝一份 Config，使调用方可以放心修改返回值而不影响已经发布出去的那一份。
+func (c *Config) clone() *Config {
+	clone := *c
+	clone.Schedule = c.Schedule.clone()
+	if c.Time != nil {
+		t := *c.Time
+		clone.Time = &t
+	}
+	return &clone
+}
+
+// clone 深拷贝一份 Schedule，NextRun/LastRun 这两个指针字段也一并复制。
+func (s *Schedule) clone() *Schedule {
+	if s == nil {
+		return nil
+	}
+	clone := *s
+	if s.LastRun != nil {
+		t := *s.LastRun
+		clone.LastRun = &t
+	}
+	if s.NextRun != nil {
+		t := *s.NextRun
+		clone.NextRun = &t
+	}
+	return &clone
+}
+
+func (c *Config) check() error {
+	if c.Current == "" {
+		return xerrors.New("current uuid is empty")
+	}
+	if c.Backup == "" {
+		return xerrors.New("backup uuid is empty")
+	}
+	if c.Current == c.Backup {
+		return xerrors.New("current uuid and backup uuid are the same")
+	}
+	return nil
+}
+
+func (c *Config) save(filename string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+func loadConfig(filename string, cfg *Config) error {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, cfg)
+}
+
+// configProvider 把当前生效的 Config 放在 atomic.Pointer 之下，使读者不需要锁就能
+// 取到一份完整的配置快照（写入方 Reload/update 之间由 mu 序列化）。Reload 和 update 只会把一份新建好的
+// Config 整体原子替换上去，从不就地修改一个已经发布出去的 Config，所以任何在
+// 某次 job 开始时取到的 *Config 都是那次 job 从头到尾可以安全使用的快照。
+type configProvider struct {
+	filename string
+	ptr      atomic.Pointer[Config]
+	// mu 序列化 update 和 Reload，避免两个并发的读改写基于同一份旧快照各自算出一份新快照，
+	// 导致后写入的那个把先写入的改动覆盖掉。
+	mu sync.Mutex
+}
+
+func newConfigProvider(filename string) (*configProvider, error) {
+	p := &configProvider{filename: filename}
+	_, err := p.Reload()
+	return p, err
+}
+
+// current 返回当前生效的配置快照。
+func (p *configProvider) current() *Config {
+	return p.ptr.Load()
+}
+
+// Reload 从磁盘重新读取配置并原子地替换当前快照，返回新配置及其是否合法。
+// 读盘失败时保留上一份已知良好的配置不动，只把失败原因返回给调用方去决定
+// 如何汇报 ConfigValid，避免一次偶发的读失败（比如 SIGHUP 时机不巧）就把
+// Current/Backup/Schedule 等全部清空。
+func (p *configProvider) Reload() (*Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cfg := &Config{}
+	err := loadConfig(p.filename, cfg)
+	if err != nil {
+		if old := p.current(); old != nil {
+			return old, err
+		}
+		p.ptr.Store(cfg)
+		return cfg, err
+	}
+	p.ptr.Store(cfg)
+	return cfg, cfg.check()
+}
+
+// update 在 mu 保护下取当前配置的一份深拷贝交给 fn 修改，然后把结果整体发布出去
+// 并落盘，而不是就地修改已经发布的那份 Config（那会和并发的读者/Reload 产生数据
+// 竞争）。fn 只应该修改传入的拷贝。
+func (p *configProvider) update(fn func(cfg *Config)) (*Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cfg := p.current().clone()
+	fn(cfg)
+	p.ptr.Store(cfg)
+	return cfg, cfg.save(p.filename)
+}
+
+func loadConfigUuid(filename string) (currentUuid, backupUuid string, err error) {
+	var cfg Config
+	err = loadConfig(filename, &cfg)
+	if err != nil {
+		return
+	}
+	currentUuid = cfg.Current
+	backupUuid = cfg.Backup
+	return
+}
@@ -0,0 +1,180 @@
+// SPDX-FileCopyrightText: 2018 - 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/godbus/dbus"
+	"github.com/linuxdeepin/go-lib/dbusutil"
+)
+
+const (
+	// EncryptionStateDisabled 表示未开启加密。
+	EncryptionStateDisabled = "disabled"
+	// EncryptionStateLocked 表示已开启加密但还没有拿到口令。
+	EncryptionStateLocked = "locked"
+	// EncryptionStateUnlocked 表示已开启加密并且口令已经就绪。
+	EncryptionStateUnlocked = "unlocked"
+
+	luksMapperName = "deepin-ab-recovery-backup"
+	luksMapperPath = "/dev/mapper/" + luksMapperName
+)
+
+// Unlock 接收一个通过 unix-peer 认证的调用者提供的口令，供后续的备份/还原使用。
+// 口令只保存在内存中，不会持久化。
+func (m *Manager) Unlock(sender dbus.Sender, passphrase string) *dbus.Error {
+	uid, err := m.callerUid(sender)
+	if err != nil {
+		return dbusutil.ToError(err)
+	}
+	if uid != 0 {
+		return dbusutil.ToError(fmt.Errorf("uid %d is not allowed to unlock", uid))
+	}
+
+	m.PropsMu.Lock()
+	m.passphrase = passphrase
+	m.PropsMu.Unlock()
+	m.refreshEncryptionState()
+	return nil
+}
+
+// callerUid 通过标准的 org.freedesktop.DBus.GetConnectionUnixUser 方法确认调用方身份，
+// 和 getLocaleEnvVarsWithSender 使用的是同一条 peer 连接。
+func (m *Manager) callerUid(sender dbus.Sender) (uint32, error) {
+	var uid uint32
+	err := m.service.Conn().BusObject().Call(
+		"org.freedesktop.DBus.GetConnectionUnixUser", 0, string(sender)).Store(&uid)
+	if err != nil {
+		return 0, err
+	}
+	return uid, nil
+}
+
+func (m *Manager) setPropEncryptionState(v string) {
+	if m.EncryptionState == v {
+		return
+	}
+	m.EncryptionState = v
+	err := m.service.EmitPropertyChanged(m, "EncryptionState", v)
+	if err != nil {
+		logger.Warning(err)
+	}
+}
+
+// refreshEncryptionState 根据当前 Config 和已有口令重新计算 EncryptionState 属性，
+// 自己持有 PropsMu，调用方不应该在已经持锁的情况下调用它。
+func (m *Manager) refreshEncryptionState() {
+	m.PropsMu.Lock()
+	defer m.PropsMu.Unlock()
+
+	cfg := m.cfg()
+	var state string
+	switch {
+	case !cfg.Encryption.Enabled:
+		state = EncryptionStateDisabled
+	case m.passphrase != "" || cfg.Encryption.KeyFile != "":
+		state = EncryptionStateUnlocked
+	default:
+		state = EncryptionStateLocked
+	}
+	m.setPropEncryptionState(state)
+}
+
+// encryptionPassphrase 返回用于开启/格式化 LUKS 容器的口令：优先用 KeyFile，
+// 否则用 Unlock 提供的、只存在内存里的口令。
+func (m *Manager) encryptionPassphrase() (string, error) {
+	if m.cfg().Encryption.KeyFile != "" {
+		data, err := os.ReadFile(m.cfg().Encryption.KeyFile)
+		if err != nil {
+			return "", fmt.Errorf("read key file: %w", err)
+		}
+		return string(bytes.TrimRight(data, "\n")), nil
+	}
+
+	m.PropsMu.RLock()
+	passphrase := m.passphrase
+	m.PropsMu.RUnlock()
+
+	if passphrase == "" {
+		return "", fmt.Errorf("encryption is locked, call Unlock first")
+	}
+	return passphrase, nil
+}
+
+func luksFormat(device, passphrase, cipher string) error {
+	args := []string{"luksFormat", "--batch-mode"}
+	if cipher != "" {
+		args = append(args, "--cipher", cipher)
+	}
+	args = append(args, device)
+	cmd := exec.Command("cryptsetup", args...)
+	cmd.Stdin = bytes.NewBufferString(passphrase + "\n")
+	return cmd.Run()
+}
+
+func luksIsFormatted(device string) bool {
+	return exec.Command("cryptsetup", "isLuks", device).Run() == nil
+}
+
+func luksOpen(device, mapperName, passphrase string) error {
+	cmd := exec.Command("cryptsetup", "luksOpen", device, mapperName)
+	cmd.Stdin = bytes.NewBufferString(passphrase + "\n")
+	return cmd.Run()
+}
+
+func luksClose(mapperName string) error {
+	return exec.Command("cryptsetup", "luksClose", mapperName).Run()
+}
+
+// partitionDevice 把 Config 里记录的分区 UUID 转换成 cryptsetup/mount 可以直接
+// 操作的设备路径。
+func partitionDevice(uuid string) string {
+	return filepath.Join("/dev/disk/by-uuid", uuid)
+}
+
+// openBackupDevice 在开启加密时保证 device 指向的备份分区已经是一个打开的 LUKS 容器，
+// 首次使用时会就地格式化，并返回 /dev/mapper 下的映射设备路径；未开启加密时原样返回 device。
+func (m *Manager) openBackupDevice(device string) (string, error) {
+	if !m.cfg().Encryption.Enabled {
+		return device, nil
+	}
+
+	passphrase, err := m.encryptionPassphrase()
+	if err != nil {
+		return "", err
+	}
+
+	if !luksIsFormatted(device) {
+		if err := luksFormat(device, passphrase, m.cfg().Encryption.Cipher); err != nil {
+			return "", fmt.Errorf("luksFormat: %w", err)
+		}
+	}
+	if err := luksOpen(device, luksMapperName, passphrase); err != nil {
+		return "", fmt.Errorf("luksOpen: %w", err)
+	}
+	return luksMapperPath, nil
+}
+
+// cryptdeviceKernelArg 生成 GRUB rollback 条目需要追加的 cryptdevice= 内核参数，
+// 使 initramfs 在启动时能够提示输入口令。
+func cryptdeviceKernelArg(uuid string) string {
+	return fmt.Sprintf("cryptdevice=UUID=%s:%s", uuid, luksMapperName)
+}
+
+// closeBackupDevice 在一次备份/还原任务结束时关闭 openBackupDevice 打开的 LUKS
+// 映射；未开启加密时什么也不做。
+func closeBackupDevice(encryptionEnabled bool) {
+	if !encryptionEnabled {
+		return
+	}
+	if err := luksClose(luksMapperName); err != nil {
+		logger.Warning("failed to close LUKS device:", err)
+	}
+}
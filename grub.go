@@ -0,0 +1,44 @@
+// SPDX-FileCopyrightText: 2018 - 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// grubCryptdeviceDropin 是写给 grub-mkconfig 的一个命令行片段，只负责在启动参数里
+// 追加 cryptdevice=；真正的回滚菜单项由 misc/11_deepin_ab_recovery 生成。
+const grubCryptdeviceDropin = "/etc/default/grub.d/99-deepin-ab-recovery-crypt.cfg"
+
+// refreshGrubConfig 在一次备份/还原成功之后重新生成 GRUB 配置，让回滚菜单项和这里
+// 写出的 cryptdevice 内核参数都跟上最新的 Config。globalNoGrubMkconfig 为真的平台
+// 不使用 GRUB，只跳过 update-grub；cryptdevice 片段仍然照常写出或删除。
+func refreshGrubConfig(cfg *Config) error {
+	if err := writeGrubCryptdeviceDropin(cfg); err != nil {
+		return err
+	}
+	if globalNoGrubMkconfig {
+		return nil
+	}
+	return exec.Command("update-grub").Run()
+}
+
+func writeGrubCryptdeviceDropin(cfg *Config) error {
+	if !cfg.Encryption.Enabled {
+		err := os.Remove(grubCryptdeviceDropin)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s: %w", grubCryptdeviceDropin, err)
+		}
+		return nil
+	}
+
+	content := fmt.Sprintf("GRUB_CMDLINE_LINUX=\"$GRUB_CMDLINE_LINUX %s\"\n", cryptdeviceKernelArg(cfg.Backup))
+	if err := os.WriteFile(grubCryptdeviceDropin, []byte(content), 0644); err != nil {
+		return fmt.Errorf("write %s: %w", grubCryptdeviceDropin, err)
+	}
+	return nil
+}
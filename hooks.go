@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: 2018 - 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const hooksDir = "/etc/deepin-ab-recovery/hooks.d"
+
+const (
+	hookStagePreBackup  = "pre-backup"
+	hookStagePostBackup = "post-backup"
+	hookStagePreRestore = "pre-restore"
+	hookStagePostRestore = "post-restore"
+)
+
+// hookEnv 携带 hook 脚本需要的上下文，以 AB_ 前缀的环境变量传入。
+type hookEnv struct {
+	kind    string
+	stage   string
+	current string
+	backup  string
+	version string
+	err     error
+}
+
+func (e hookEnv) environ() []string {
+	env := []string{
+		"AB_JOB_KIND=" + e.kind,
+		"AB_JOB_STAGE=" + e.stage,
+		"AB_CURRENT_UUID=" + e.current,
+		"AB_BACKUP_UUID=" + e.backup,
+		"AB_BACKUP_VERSION=" + e.version,
+	}
+	if e.err != nil {
+		env = append(env, "AB_ERROR="+e.err.Error())
+	}
+	return env
+}
+
+// runHooks 按字典序依次执行 hooksDir/stage 目录下的可执行文件。
+// pre-* 阶段一旦有脚本非零退出就中止整个任务；post-* 阶段的失败只记录日志，不影响结果。
+func runHooks(stage string, env hookEnv, timeout time.Duration) error {
+	dir := filepath.Join(hooksDir, stage)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read hooks dir %s: %w", dir, err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	fatal := stage == hookStagePreBackup || stage == hookStagePreRestore
+
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := runHook(path, env, timeout); err != nil {
+			if fatal {
+				return fmt.Errorf("hook %s failed: %w", path, err)
+			}
+			logger.Warning("hook failed (ignored):", path, err)
+		}
+	}
+	return nil
+}
+
+// runWithHooks 在 pre/post 两个 hook 阶段之间执行 fn：pre-hook 失败会直接中止，
+// fn 根本不会被调用；post-hook 无论 fn 成功与否都会执行，其失败只记录日志，
+// 不会掩盖 fn 本身的错误。
+func (m *Manager) runWithHooks(preStage, postStage string, env hookEnv, fn func() error) error {
+	timeout := m.cfg().HookTimeout
+
+	env.stage = preStage
+	if err := runHooks(preStage, env, timeout); err != nil {
+		return err
+	}
+
+	err := fn()
+
+	env.stage = postStage
+	env.err = err
+	if hookErr := runHooks(postStage, env, timeout); hookErr != nil {
+		logger.Warning("post hook failed:", hookErr)
+	}
+
+	return err
+}
+
+func runHook(path string, env hookEnv, timeout time.Duration) error {
+	ctx := context.Background()
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = append(os.Environ(), env.environ()...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	return nil
+}
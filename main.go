@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2018 - 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/linuxdeepin/go-lib/dbusutil"
+	"github.com/linuxdeepin/go-lib/log"
+)
+
+var logger = log.NewLogger("ab-recovery")
+
+func main() {
+	service, err := dbusutil.NewSystemService()
+	if err != nil {
+		logger.Fatal("failed to new system service:", err)
+	}
+
+	hasOwner, err := service.NameHasOwner(dbusServiceName)
+	if err != nil {
+		logger.Fatal("failed to call NameHasOwner:", err)
+	}
+	if hasOwner {
+		logger.Warning("service already exists, exit")
+		return
+	}
+
+	m := newManager(service)
+	err = service.Export(dbusPath, m)
+	if err != nil {
+		logger.Fatal("failed to export manager:", err)
+	}
+
+	err = service.RequestName(dbusServiceName)
+	if err != nil {
+		logger.Fatal("failed to request name:", err)
+	}
+
+	installSighupHandler(m)
+
+	service.SetAutoQuitHandler(3*60, m.canQuit)
+	service.Wait()
+}
+
+// installSighupHandler 让 daemon 在收到 SIGHUP 时重新加载配置，
+// 而不必重启整个服务（类似 systemd 的 ExecReload）。
+func installSighupHandler(m *Manager) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	go func() {
+		for range sigCh {
+			m.reload()
+		}
+	}()
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"os"
 	"os/exec"
@@ -34,16 +35,20 @@ var msgRollBack = Tr("Roll back to %s (%s)")
 //go:generate dbusutil-gen em -type Manager
 
 type Manager struct {
-	service       *dbusutil.Service
-	PropsMu       sync.RWMutex
-	BackingUp     bool
-	Restoring     bool
-	ConfigValid   bool
-	BackupVersion string
-	BackupTime    int64
-	HasBackedUp   bool
-
-	cfg Config
+	service         *dbusutil.Service
+	PropsMu         sync.RWMutex
+	BackingUp       bool
+	Restoring       bool
+	ConfigValid     bool
+	BackupVersion   string
+	BackupTime      int64
+	HasBackedUp     bool
+	EncryptionState string
+
+	cfgp       *configProvider
+	scheduler  *scheduler
+	jobs       *jobTracker
+	passphrase string
 
 	//nolint
 	signals *struct {
@@ -52,36 +57,103 @@ type Manager struct {
 			success bool
 			errMsg  string
 		}
+
+		JobProgress struct {
+			kind       string
+			fraction   float64
+			bytesDone  uint64
+			bytesTotal uint64
+			stage      string
+		}
+
+		MissedRun struct {
+			lastScheduled int64
+			withinLeeway  bool
+		}
+
+		ConfigReloaded struct {
+			configValid bool
+		}
 	}
 }
 
+// cfg 返回当前生效的配置快照；进行中的 job 应该在开始时取一次，而不要在 job 运行
+// 期间反复调用，因为 SIGHUP 触发的 Reload 随时可能换上一份新的 Config。
+func (m *Manager) cfg() *Config {
+	return m.cfgp.current()
+}
+
 func newManager(service *dbusutil.Service) *Manager {
 	m := &Manager{
 		service: service,
+		jobs:    newJobTracker(),
 	}
 	m.HasBackedUp = backupFinishedFileExist(abBackupFinishedFile)
-	//var cfg Config
-	err := loadConfig(configFile, &m.cfg)
+
+	cfgp, err := newConfigProvider(configFile)
 	if err != nil {
 		logger.Warning("failed to load config:", err)
 	}
-	logger.Debug("current:", m.cfg.Current)
-	logger.Debug("backup:", m.cfg.Backup)
+	m.cfgp = cfgp
+	cfg := m.cfg()
+	logger.Debug("current:", cfg.Current)
+	logger.Debug("backup:", cfg.Backup)
+
+	if checkErr := cfg.check(); checkErr != nil {
+		logger.Warning(checkErr)
+	} else {
+		m.ConfigValid = true
+	}
+
+	if m.ConfigValid {
+		if cfg.Time != nil {
+			m.BackupTime = cfg.Time.Unix()
+		}
+		m.BackupVersion = cfg.Version
+	}
+
+	m.refreshEncryptionState()
+
+	m.scheduler = newScheduler(m)
+	m.scheduler.start()
+
+	return m
+}
+
+// reload 在收到 SIGHUP 时被调用，重新从磁盘加载配置并广播 ConfigReloaded。
+// 只要还有备份/还原在跑，就拒绝重新加载并只记录一条警告，避免在 job 进行到一半时
+// 换掉 Current/Backup 这类分区 UUID。
+func (m *Manager) reload() {
+	m.PropsMu.Lock()
+	busy := m.BackingUp || m.Restoring
+	m.PropsMu.Unlock()
+	if busy {
+		logger.Warning("ignoring config reload: a job is still running")
+		return
+	}
 
-	err = m.cfg.check()
+	cfg, err := m.cfgp.Reload()
 	if err != nil {
-		logger.Warning(err)
+		logger.Warning("failed to reload config:", err)
 	}
-	m.ConfigValid = err == nil
 
+	m.PropsMu.Lock()
+	m.setPropConfigValid(err == nil)
 	if m.ConfigValid {
-		if m.cfg.Time != nil {
-			m.BackupTime = m.cfg.Time.Unix()
+		if cfg.Time != nil {
+			m.setPropBackupTime(cfg.Time.Unix())
 		}
-		m.BackupVersion = m.cfg.Version
+		m.setPropBackupVersion(cfg.Version)
 	}
+	m.PropsMu.Unlock()
 
-	return m
+	m.refreshEncryptionState()
+	m.scheduler.reloadSchedule()
+
+	emitErr := m.service.Emit(m, "ConfigReloaded", m.ConfigValid)
+	if emitErr != nil {
+		logger.Warning("failed to emit ConfigReloaded:", emitErr)
+	}
 }
 
 func (m *Manager) GetInterfaceName() string {
@@ -102,12 +174,15 @@ func (m *Manager) canBackup() (bool, error) {
 	if !m.ConfigValid {
 		return false, nil
 	}
+	if m.cfg().Encryption.Enabled && m.EncryptionState == EncryptionStateLocked {
+		return false, nil
+	}
 
 	rootUuid, err := getRootUuid()
 	if err != nil {
 		return false, err
 	}
-	return rootUuid == m.cfg.Current, nil
+	return rootUuid == m.cfg().Current, nil
 }
 
 func (m *Manager) CanBackup() (can bool, busErr *dbus.Error) {
@@ -115,7 +190,9 @@ func (m *Manager) CanBackup() (can bool, busErr *dbus.Error) {
 	return can, dbusutil.ToError(err)
 }
 
-func (m *Manager) canRestore() (bool, error) {
+// canRestore 检查是否可以执行一次还原。id 为空表示还原最新的一代；
+// 非空时还要确认对应的快照确实存在。
+func (m *Manager) canRestore(id string) (bool, error) {
 	if globalNoGrubMkconfig {
 		if isArchMips() {
 			// pass
@@ -129,15 +206,40 @@ func (m *Manager) canRestore() (bool, error) {
 	if !m.ConfigValid {
 		return false, nil
 	}
+	if m.cfg().Encryption.Enabled && m.EncryptionState == EncryptionStateLocked {
+		return false, nil
+	}
 	rootUuid, err := getRootUuid()
 	if err != nil {
 		return false, err
 	}
-	return rootUuid == m.cfg.Backup, nil
+	if rootUuid != m.cfg().Backup {
+		return false, nil
+	}
+	if id == "" {
+		return true, nil
+	}
+
+	cfg := m.cfg()
+	var infos []BackupInfo
+	err = m.withBackupDevice(cfg, func() error {
+		var err error
+		infos, err = listSnapshots(retentionPrefix(cfg.Retention))
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, info := range infos {
+		if info.Id == id {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (m *Manager) CanRestore() (can bool, busErr *dbus.Error) {
-	can, err := m.canRestore()
+	can, err := m.canRestore("")
 	return can, dbusutil.ToError(err)
 }
 
@@ -174,9 +276,9 @@ func (m *Manager) startBackup(envVars []string) error {
 		m.PropsMu.Lock()
 		m.setPropBackingUp(false)
 		if err == nil {
-			backupTime := m.cfg.Time.Unix()
+			backupTime := m.cfg().Time.Unix()
 			m.setPropBackupTime(backupTime)
-			m.setPropBackupVersion(m.cfg.Version)
+			m.setPropBackupVersion(m.cfg().Version)
 			creatFile(abBackupFinishedFile)
 			m.setPropHasBackedUp(true)
 		}
@@ -196,8 +298,9 @@ func (m *Manager) StartBackup(sender dbus.Sender) *dbus.Error {
 	return dbusutil.ToError(err)
 }
 
-func (m *Manager) startRestore(envVars []string) error {
-	can, err := m.canRestore()
+// startRestore 发起一次还原。id 为空表示还原最新的一代。
+func (m *Manager) startRestore(envVars []string, id string) error {
+	can, err := m.canRestore(id)
 	if err != nil {
 		return err
 	}
@@ -220,7 +323,7 @@ func (m *Manager) startRestore(envVars []string) error {
 	}
 
 	go func() {
-		err := m.restore(envVars)
+		err := m.restore(envVars, id)
 		if err != nil {
 			logger.Warning("failed to restore:", err)
 		}
@@ -244,7 +347,7 @@ func (m *Manager) StartRestore(sender dbus.Sender) *dbus.Error {
 	if err != nil {
 		return dbusutil.ToError(err)
 	}
-	err = m.startRestore(envVars)
+	err = m.startRestore(envVars, "")
 	return dbusutil.ToError(err)
 }
 
@@ -282,15 +385,59 @@ func inhibitShutdownDo(why string, fn func() error) error {
 	return err
 }
 
+// backup 跑一次完整的备份任务。cfg 在任务开始时取一份快照，整个任务期间都只用
+// 这一份，即使期间收到 SIGHUP 也不会让 job 中途看到不一致的 Current/Backup。
 func (m *Manager) backup(envVars []string) error {
-	return inhibitShutdownDo(Tr("Backing up the system"), func() error {
-		return backup(&m.cfg, envVars)
+	cfg := m.cfg()
+	ctx, cancel := m.jobs.start(jobKindBackup)
+	defer cancel()
+	defer m.jobs.finish(jobKindBackup)
+
+	return m.withBackupDevice(cfg, func() error {
+		env := hookEnv{kind: jobKindBackup, current: cfg.Current, backup: cfg.Backup, version: cfg.Version}
+		return inhibitShutdownDo(Tr("Backing up the system"), func() error {
+			return m.runWithHooks(hookStagePreBackup, hookStagePostBackup, env, func() error {
+				if cfg.Retention.Count > 0 || cfg.Retention.MaxAge > 0 {
+					if _, err := createSnapshot(cfg); err != nil {
+						return err
+					}
+					if _, err := pruneSnapshots(cfg, false); err != nil {
+						logger.Warning("failed to prune snapshots:", err)
+					}
+				}
+				if err := rsyncTo(ctx, "/", backupMountPoint, jobKindBackup, envVars, func(p jobProgress) {
+					m.emitSignalJobProgress(p)
+				}); err != nil {
+					return err
+				}
+				return refreshGrubConfig(cfg)
+			})
+		})
 	})
 }
 
-func (m *Manager) restore(envVars []string) error {
-	return inhibitShutdownDo(Tr("Restoring the system"), func() error {
-		return restore(&m.cfg, envVars)
+// restore 还原到 id 指定的快照；id 为空表示还原当前的备份分区内容（最新一代）。
+// 和 backup 一样，cfg 在任务开始时取一份快照并贯穿整个任务。
+func (m *Manager) restore(envVars []string, id string) error {
+	cfg := m.cfg()
+	ctx, cancel := m.jobs.start(jobKindRestore)
+	defer cancel()
+	defer m.jobs.finish(jobKindRestore)
+
+	return m.withBackupDevice(cfg, func() error {
+		src := backupMountPoint
+		if id != "" {
+			src = snapshotPath(retentionPrefix(cfg.Retention), id)
+		}
+
+		env := hookEnv{kind: jobKindRestore, current: cfg.Current, backup: cfg.Backup, version: cfg.Version}
+		return inhibitShutdownDo(Tr("Restoring the system"), func() error {
+			return m.runWithHooks(hookStagePreRestore, hookStagePostRestore, env, func() error {
+				return rsyncTo(ctx, src, "/", jobKindRestore, envVars, func(p jobProgress) {
+					m.emitSignalJobProgress(p)
+				})
+			})
+		})
 	})
 }
 
@@ -308,6 +455,9 @@ func (m *Manager) emitSignalJobEnd(kind string, err error) {
 	var errMsg string
 	if err != nil {
 		errMsg = err.Error()
+		if errors.Is(err, context.Canceled) {
+			errMsg = "cancelled"
+		}
 	}
 	success := err == nil
 	emitErr := m.service.Emit(m, "JobEnd", kind, success, errMsg)
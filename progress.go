@@ -0,0 +1,141 @@
+// SPDX-FileCopyrightText: 2018 - 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/linuxdeepin/go-lib/dbusutil"
+)
+
+// jobProgress 是 JobProgress 信号一次推送的内容。
+type jobProgress struct {
+	kind       string
+	fraction   float64
+	bytesDone  uint64
+	bytesTotal uint64
+	stage      string
+}
+
+// job 跟踪一个正在执行的备份/还原任务，使其可以被取消并汇报进度。
+type job struct {
+	kind   string
+	cancel context.CancelFunc
+}
+
+// jobTracker 在 Manager 上记录当前正在运行的任务；jobs 由 jobTracker 自己的 mu 保护，
+// 不使用 PropsMu。
+type jobTracker struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{jobs: make(map[string]*job)}
+}
+
+func (t *jobTracker) start(kind string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.mu.Lock()
+	t.jobs[kind] = &job{kind: kind, cancel: cancel}
+	t.mu.Unlock()
+	return ctx, cancel
+}
+
+func (t *jobTracker) finish(kind string) {
+	t.mu.Lock()
+	delete(t.jobs, kind)
+	t.mu.Unlock()
+}
+
+func (t *jobTracker) cancel(kind string) bool {
+	t.mu.Lock()
+	j, ok := t.jobs[kind]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	j.cancel()
+	return true
+}
+
+func (m *Manager) CancelJob(kind string) *dbus.Error {
+	switch kind {
+	case jobKindBackup, jobKindRestore:
+		// pass
+	default:
+		return dbusutil.ToError(errors.New("invalid kind " + kind))
+	}
+	if !m.jobs.cancel(kind) {
+		return dbusutil.ToError(errors.New("no running job of kind " + kind))
+	}
+	return nil
+}
+
+func (m *Manager) emitSignalJobProgress(p jobProgress) {
+	err := m.service.Emit(m, "JobProgress", p.kind, p.fraction, p.bytesDone, p.bytesTotal, p.stage)
+	if err != nil {
+		logger.Warning("failed to emit JobProgress:", err)
+	}
+}
+
+// rsyncProgressRegexp 匹配 rsync --info=progress2 的输出，例如：
+// "      1,234,567  42%   12.34MB/s    0:00:05"
+var rsyncProgressRegexp = regexp.MustCompile(`^\s*([\d,]+)\s+(\d+)%`)
+
+// watchRsyncProgress 逐行读取 rsync --info=progress2 的输出，解析出已传输字节数与完成百分比，
+// 并以约 1 Hz 的频率通过 report 回调汇报。
+func watchRsyncProgress(r io.Reader, kind, stage string, bytesTotal uint64, report func(jobProgress)) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+	// rsync 用 \r 刷新同一行，bufio.ScanLines 按 \n 分割，这里把 \r 也当作行结束符处理。
+	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if i := strings.IndexAny(string(data), "\r\n"); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	var lastReport time.Time
+	for scanner.Scan() {
+		line := scanner.Text()
+		m := rsyncProgressRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if time.Since(lastReport) < time.Second {
+			continue
+		}
+		lastReport = time.Now()
+
+		bytesDone, err := strconv.ParseUint(strings.ReplaceAll(m[1], ",", ""), 10, 64)
+		if err != nil {
+			continue
+		}
+		percent, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			continue
+		}
+		report(jobProgress{
+			kind:       kind,
+			fraction:   percent / 100,
+			bytesDone:  bytesDone,
+			bytesTotal: bytesTotal,
+			stage:      stage,
+		})
+	}
+}
@@ -0,0 +1,109 @@
+// SPDX-FileCopyrightText: 2018 - 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"syscall"
+)
+
+// mountBackupDevice 把 device（明文分区或者 openBackupDevice 打开好的 LUKS 映射）
+// 挂载到 backupMountPoint；调用方负责在用完之后调用 unmountBackupDevice。
+func mountBackupDevice(device string) error {
+	if err := os.MkdirAll(backupMountPoint, 0755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", backupMountPoint, err)
+	}
+	if err := exec.Command("mount", device, backupMountPoint).Run(); err != nil {
+		return fmt.Errorf("mount %s: %w", device, err)
+	}
+	return nil
+}
+
+func unmountBackupDevice() {
+	if err := exec.Command("umount", backupMountPoint).Run(); err != nil {
+		logger.Warning("failed to unmount backup device:", err)
+	}
+}
+
+// withBackupDevice 打开（必要时格式化）备份设备并挂载到 backupMountPoint，执行 fn，
+// 结束后按相反顺序卸载、关闭。backup/restore 这类任务型操作和 ListBackups/PruneBackups
+// 这类只是读写 snapshotsRoot 的操作，共用同一套挂载生命周期。
+func (m *Manager) withBackupDevice(cfg *Config, fn func() error) error {
+	device, err := m.openBackupDevice(partitionDevice(cfg.Backup))
+	if err != nil {
+		return err
+	}
+	defer closeBackupDevice(cfg.Encryption.Enabled)
+
+	if err := mountBackupDevice(device); err != nil {
+		return err
+	}
+	defer unmountBackupDevice()
+
+	return fn()
+}
+
+// rsyncStatsTotalRegexp 匹配 rsync --stats 输出里的 "Total file size: 1,234 bytes"。
+var rsyncStatsTotalRegexp = regexp.MustCompile(`(?m)^Total file size:\s*([\d,]+)\s+bytes`)
+
+// rsyncTotalBytes 用 --dry-run --stats 预跑一遍 rsync，解析出源端全部文件的总字节数
+// （Total file size，不是其中需要实际传输的部分），供 watchRsyncProgress 填充
+// JobProgress 信号里的 bytesTotal 字段。
+// 预跑失败或者解析不出来时返回 0，调用方不必因此中止真正的同步。
+func rsyncTotalBytes(ctx context.Context, src, dst string) uint64 {
+	out, err := exec.CommandContext(ctx, "rsync", "-aAX", "--delete", "--dry-run", "--stats", src, dst).Output()
+	if err != nil {
+		logger.Warning("failed to estimate rsync total size:", err)
+		return 0
+	}
+	m := rsyncStatsTotalRegexp.FindSubmatch(out)
+	if m == nil {
+		return 0
+	}
+	total, err := strconv.ParseUint(string(bytes.ReplaceAll(m[1], []byte(","), nil)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return total
+}
+
+// rsyncTo 用 rsync --info=progress2 把 src 同步到 dst，边跑边把解析出来的进度喂给
+// report，并在 ctx 被取消时连带终止整个 rsync 进程组（rsync 的远程 shell 传输方式
+// 可能会派生子进程，只杀 rsync 自己不够）。envVars 是调用方 DBus 连接上带来的
+// locale 环境变量，透传给 rsync 子进程使其报错信息和调用者保持同一语言。
+func rsyncTo(ctx context.Context, src, dst, kind string, envVars []string, report func(jobProgress)) error {
+	bytesTotal := rsyncTotalBytes(ctx, src, dst)
+
+	cmd := exec.CommandContext(ctx, "rsync", "-aAX", "--delete", "--info=progress2", src, dst)
+	cmd.Env = append(os.Environ(), envVars...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("stdout pipe: %w", err)
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start rsync: %w", err)
+	}
+	watchRsyncProgress(stdout, kind, "syncing", bytesTotal, report)
+	if err := cmd.Wait(); err != nil {
+		// 被 ctx 取消杀掉的 rsync 只会返回普通的退出错误，这里把 ctx.Err() 包进去，
+		// 使上层可以用 errors.Is(err, context.Canceled) 识别取消。
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("%w: %v", ctxErr, err)
+		}
+		return err
+	}
+	return nil
+}
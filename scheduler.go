@@ -0,0 +1,317 @@
+// SPDX-FileCopyrightText: 2018 - 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/linuxdeepin/go-lib/dbusutil"
+)
+
+// Schedule 描述自动备份的定时策略，整体持久化在 Config 中，
+// 以便 daemon 重启后仍能续上原计划（类似 systemd timer 的 Persistent= 语义）。
+type Schedule struct {
+	Expr            string
+	SkipIfOnBattery bool
+	Jitter          time.Duration
+	// CatchUpLeeway 是错过的计划在多久之内还允许补跑一次，<= 0 表示不限制。
+	CatchUpLeeway time.Duration
+	LastRun       *time.Time
+	NextRun       *time.Time
+}
+
+// cronSchedule 是 Schedule.Expr 解析后的结果，字段含义与标准 5 段 cron 表达式一致：
+// 分 时 日 月 星期。
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	sets := make([]map[int]bool, 5)
+	for i, f := range fields {
+		set, err := parseCronField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+	return &cronSchedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		rangePart := part
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			rangePart = part[:idx]
+			s, err := strconv.Atoi(part[idx+1:])
+			if err != nil || s <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step = s
+		}
+		lo, hi := min, max
+		if rangePart != "*" {
+			if dash := strings.Index(rangePart, "-"); dash >= 0 {
+				var err error
+				lo, err = strconv.Atoi(rangePart[:dash])
+				if err != nil {
+					return nil, fmt.Errorf("invalid range in %q", part)
+				}
+				hi, err = strconv.Atoi(rangePart[dash+1:])
+				if err != nil {
+					return nil, fmt.Errorf("invalid range in %q", part)
+				}
+			} else {
+				v, err := strconv.Atoi(rangePart)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value in %q", part)
+				}
+				lo, hi = v, v
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("value out of range in %q", part)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// next 返回 from 之后（不含 from 自身所在分钟）第一个满足 cron 表达式的时间点。
+func (s *cronSchedule) next(from time.Time) time.Time {
+	t := from.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(4, 0, 0)
+	for t.Before(limit) {
+		if s.month[int(t.Month())] && s.dom[t.Day()] && s.dow[int(t.Weekday())] &&
+			s.hour[t.Hour()] && s.minute[t.Minute()] {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+// scheduler 负责把 Config.Schedule 转换成一次实际的定时器，并在到期时触发备份。
+type scheduler struct {
+	mu      sync.Mutex
+	manager *Manager
+	cron    *cronSchedule
+	timer   *time.Timer
+}
+
+func newScheduler(m *Manager) *scheduler {
+	return &scheduler{manager: m}
+}
+
+// start 在 daemon 启动时调用一次：检测是否错过了上次计划，必要时补跑，然后安排下一次触发。
+func (s *scheduler) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sched := s.manager.cfg().Schedule
+	if sched == nil || sched.Expr == "" {
+		return
+	}
+	cron, err := parseCron(sched.Expr)
+	if err != nil {
+		logger.Warning("invalid schedule expr:", err)
+		return
+	}
+	s.cron = cron
+
+	s.checkMissedRun(sched)
+	s.armLocked()
+}
+
+// reloadSchedule 在 SIGHUP 触发配置重载之后调用，让定时器改用新配置里的 cron
+// 表达式（如果变了）重新计算下一次触发时间；和 start 不同，这里不做开机时那种
+// 错过检测，只是让正在跑的定时器跟上磁盘上最新的 Schedule。
+func (s *scheduler) reloadSchedule() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sched := s.manager.cfg().Schedule
+	if sched == nil || sched.Expr == "" {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		s.cron = nil
+		return
+	}
+
+	cron, err := parseCron(sched.Expr)
+	if err != nil {
+		logger.Warning("invalid schedule expr:", err)
+		return
+	}
+	s.cron = cron
+	s.armLocked()
+}
+
+// checkMissedRun 检测上次计划触发的时间是否已经过去但从未执行（机器关机错过了），
+// 错过时总是广播 MissedRun 信号（withinLeeway 表示是否还在 CatchUpLeeway 窗口内），
+// 并且在窗口内时直接补跑一次备份。
+func (s *scheduler) checkMissedRun(sched *Schedule) {
+	if sched.NextRun == nil {
+		return
+	}
+	now := time.Now()
+	if now.Before(*sched.NextRun) {
+		return
+	}
+	if sched.LastRun != nil && sched.LastRun.After(*sched.NextRun) {
+		return
+	}
+	overdue := now.Sub(*sched.NextRun)
+	withinLeeway := sched.CatchUpLeeway <= 0 || overdue <= sched.CatchUpLeeway
+	err := s.manager.service.Emit(s.manager, "MissedRun", sched.NextRun.Unix(), withinLeeway)
+	if err != nil {
+		logger.Warning("failed to emit MissedRun:", err)
+	}
+	if withinLeeway {
+		logger.Info("missed scheduled backup, catching up now")
+		err := s.manager.startBackup(nil)
+		if err != nil {
+			logger.Warning("failed to run catch-up backup:", err)
+		}
+	}
+}
+
+// armLocked 根据 cron 表达式计算下一次触发时间（可附加随机抖动），通过
+// configProvider 把新的 NextRun 整体发布出去（而不是就地改已发布的 Schedule），
+// 然后安排一个 time.AfterFunc。调用方必须持有 s.mu。
+func (s *scheduler) armLocked() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	sched := s.manager.cfg().Schedule
+	if s.cron == nil || sched == nil {
+		return
+	}
+
+	next := s.cron.next(time.Now())
+	if next.IsZero() {
+		logger.Warning("cron expression never fires")
+		return
+	}
+	if sched.Jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(sched.Jitter))))
+	}
+
+	_, err := s.manager.cfgp.update(func(cfg *Config) {
+		if cfg.Schedule != nil {
+			cfg.Schedule.NextRun = &next
+		}
+	})
+	if err != nil {
+		logger.Warning("failed to persist schedule:", err)
+	}
+
+	delay := time.Until(next)
+	if delay < 0 {
+		delay = 0
+	}
+	s.timer = time.AfterFunc(delay, s.fire)
+}
+
+func (s *scheduler) fire() {
+	s.mu.Lock()
+	sched := s.manager.cfg().Schedule
+	if sched == nil {
+		s.mu.Unlock()
+		return
+	}
+	if sched.SkipIfOnBattery && isOnBattery() {
+		logger.Info("skip scheduled backup, running on battery")
+		s.armLocked()
+		s.mu.Unlock()
+		return
+	}
+
+	_, err := s.manager.cfgp.update(func(cfg *Config) {
+		if cfg.Schedule != nil {
+			now := time.Now()
+			cfg.Schedule.LastRun = &now
+		}
+	})
+	if err != nil {
+		logger.Warning("failed to persist schedule:", err)
+	}
+	s.armLocked()
+	s.mu.Unlock()
+
+	err = s.manager.startBackup(nil)
+	if err != nil {
+		logger.Warning("failed to run scheduled backup:", err)
+	}
+}
+
+// isOnBattery 是留给具体平台实现的电源状态探测点，目前总是返回 false。
+func isOnBattery() bool {
+	return false
+}
+
+func (m *Manager) SetSchedule(expr string) *dbus.Error {
+	cron, err := parseCron(expr)
+	if err != nil {
+		return dbusutil.ToError(err)
+	}
+
+	_, err = m.cfgp.update(func(cfg *Config) {
+		if cfg.Schedule == nil {
+			cfg.Schedule = &Schedule{}
+		}
+		cfg.Schedule.Expr = expr
+	})
+	if err != nil {
+		return dbusutil.ToError(err)
+	}
+
+	m.scheduler.mu.Lock()
+	m.scheduler.cron = cron
+	m.scheduler.armLocked()
+	m.scheduler.mu.Unlock()
+	return nil
+}
+
+// GetSchedule 读取的是某次 Reload/update 发布出来的 Schedule 快照，发布之后就不再
+// 被就地修改，因此不需要额外加锁。
+func (m *Manager) GetSchedule() (expr string, nextRun int64, busErr *dbus.Error) {
+	sched := m.cfg().Schedule
+	if sched == nil {
+		return "", 0, nil
+	}
+	expr = sched.Expr
+	if sched.NextRun != nil {
+		nextRun = sched.NextRun.Unix()
+	}
+	return expr, nextRun, nil
+}
+
+func (m *Manager) TriggerNow() *dbus.Error {
+	err := m.startBackup(nil)
+	return dbusutil.ToError(err)
+}
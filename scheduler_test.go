@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2018 - 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	cases := []struct {
+		field   string
+		min     int
+		max     int
+		want    []int
+		wantErr bool
+	}{
+		{field: "*", min: 0, max: 4, want: []int{0, 1, 2, 3, 4}},
+		{field: "5", min: 0, max: 59, want: []int{5}},
+		{field: "1,3,5", min: 0, max: 10, want: []int{1, 3, 5}},
+		{field: "1-3", min: 0, max: 10, want: []int{1, 2, 3}},
+		{field: "*/15", min: 0, max: 59, want: []int{0, 15, 30, 45}},
+		{field: "10-20/5", min: 0, max: 59, want: []int{10, 15, 20}},
+		{field: "7", min: 0, max: 6, wantErr: true},
+		{field: "3-1", min: 0, max: 6, wantErr: true},
+		{field: "*/0", min: 0, max: 6, wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseCronField(c.field, c.min, c.max)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseCronField(%q, %d, %d) expected error, got none", c.field, c.min, c.max)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCronField(%q, %d, %d) unexpected error: %v", c.field, c.min, c.max, err)
+			continue
+		}
+		for _, v := range c.want {
+			if !got[v] {
+				t.Errorf("parseCronField(%q, %d, %d) missing value %d, got %v", c.field, c.min, c.max, v, got)
+			}
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("parseCronField(%q, %d, %d) = %v, want %v", c.field, c.min, c.max, got, c.want)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	if _, err := parseCron("0 3 * * *"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := parseCron("0 3 * *"); err == nil {
+		t.Error("expected error for cron expression with too few fields")
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	sched, err := parseCron("30 4 * * *")
+	if err != nil {
+		t.Fatalf("parseCron: %v", err)
+	}
+	from := time.Date(2026, 7, 29, 10, 0, 0, 0, time.UTC)
+	next := sched.next(from)
+	want := time.Date(2026, 7, 30, 4, 30, 0, 0, time.UTC)
+	if !next.Equal(want) {
+		t.Errorf("next(%v) = %v, want %v", from, next, want)
+	}
+
+	// from 恰好落在下一次触发的前一分钟，next 应该返回同一天。
+	from = time.Date(2026, 7, 30, 4, 29, 0, 0, time.UTC)
+	next = sched.next(from)
+	if !next.Equal(want) {
+		t.Errorf("next(%v) = %v, want %v", from, next, want)
+	}
+
+	// from 自身所在的这一分钟即使满足条件也不应该被当作结果返回。
+	from = want
+	next = sched.next(from)
+	wantNextDay := want.AddDate(0, 0, 1)
+	if !next.Equal(wantNextDay) {
+		t.Errorf("next(%v) = %v, want %v", from, next, wantNextDay)
+	}
+}
+
+func TestCronScheduleNextNeverFires(t *testing.T) {
+	sched, err := parseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatalf("parseCron: %v", err)
+	}
+	if next := sched.next(time.Now()); !next.IsZero() {
+		t.Errorf("expected zero time for a schedule that never fires, got %v", next)
+	}
+}
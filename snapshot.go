@@ -0,0 +1,178 @@
+// SPDX-FileCopyrightText: 2018 - 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/linuxdeepin/go-lib/dbusutil"
+)
+
+const defaultRetentionPrefix = "ab-recovery-"
+
+// backupMountPoint 是备份分区 btrfs 顶层子卷的挂载点；备份任务期间一直挂载在
+// 这里，以便 createSnapshot 可以原地对它打快照。
+const backupMountPoint = "/boot/deepin-ab-recovery-backup"
+
+// snapshotsRoot 必须和 backupMountPoint 挂载的是同一个 btrfs 文件系统，
+// 这样 createSnapshot 才能用 btrfs subvolume snapshot 原地打快照，
+// 而不会因为跨设备触发 "Invalid cross-device link"。
+var snapshotsRoot = filepath.Join(backupMountPoint, ".snapshots")
+
+// BackupInfo 描述一个已经生成的备份快照，用于 ListBackups 返回给调用方。
+type BackupInfo struct {
+	Id      string
+	Time    int64
+	Version string
+}
+
+func retentionPrefix(r Retention) string {
+	if r.Prefix != "" {
+		return r.Prefix
+	}
+	return defaultRetentionPrefix
+}
+
+func snapshotPath(prefix, id string) string {
+	return filepath.Join(snapshotsRoot, prefix+id)
+}
+
+// listSnapshots 枚举 snapshotsRoot 下所有以 prefix 开头的 btrfs 只读子卷，
+// 按创建时间（从目录名里解析出的 id 时间戳）从新到旧排序。
+func listSnapshots(prefix string) ([]BackupInfo, error) {
+	entries, err := os.ReadDir(snapshotsRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var infos []BackupInfo
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		id := strings.TrimPrefix(entry.Name(), prefix)
+		t, err := time.Parse(time.RFC3339, id)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, BackupInfo{Id: id, Time: t.Unix()})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Time > infos[j].Time })
+	return infos, nil
+}
+
+// createSnapshot 在覆盖备份分区之前，对它做一个只读的 btrfs 快照，
+// 子卷名形如 <prefix><RFC3339 时间戳>。
+func createSnapshot(cfg *Config) (BackupInfo, error) {
+	if err := os.MkdirAll(snapshotsRoot, 0755); err != nil {
+		return BackupInfo{}, fmt.Errorf("mkdir snapshots root: %w", err)
+	}
+
+	prefix := retentionPrefix(cfg.Retention)
+	id := time.Now().UTC().Format(time.RFC3339)
+	dest := snapshotPath(prefix, id)
+
+	err := exec.Command("btrfs", "subvolume", "snapshot", "-r", backupMountPoint, dest).Run()
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("btrfs snapshot: %w", err)
+	}
+
+	return BackupInfo{Id: id, Time: time.Now().Unix(), Version: cfg.Version}, nil
+}
+
+func removeSnapshot(prefix, id string) error {
+	return exec.Command("btrfs", "subvolume", "delete", snapshotPath(prefix, id)).Run()
+}
+
+// pruneSnapshots 应用 Retention 策略，返回被（或将被）删除的快照列表。
+// 数量超限和超龄的快照都会被清理，但无论策略多严格，至少保留最新的一代。
+func pruneSnapshots(cfg *Config, dryRun bool) ([]BackupInfo, error) {
+	prefix := retentionPrefix(cfg.Retention)
+	infos, err := listSnapshots(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) <= 1 {
+		return nil, nil
+	}
+
+	keep := len(infos)
+	if cfg.Retention.Count > 0 && cfg.Retention.Count < keep {
+		keep = cfg.Retention.Count
+	}
+	if keep < 1 {
+		keep = 1
+	}
+
+	var cutoff time.Time
+	if cfg.Retention.MaxAge > 0 {
+		cutoff = time.Now().Add(-cfg.Retention.MaxAge)
+	}
+
+	var toRemove []BackupInfo
+	for i, info := range infos {
+		if i == 0 {
+			// 永远保留最新的一代。
+			continue
+		}
+		stale := i >= keep || (!cutoff.IsZero() && time.Unix(info.Time, 0).Before(cutoff))
+		if stale {
+			toRemove = append(toRemove, info)
+		}
+	}
+
+	if dryRun {
+		return toRemove, nil
+	}
+
+	var removed []BackupInfo
+	for _, info := range toRemove {
+		if err := removeSnapshot(prefix, info.Id); err != nil {
+			logger.Warning("failed to remove snapshot:", info.Id, err)
+			continue
+		}
+		removed = append(removed, info)
+	}
+	return removed, nil
+}
+
+// ListBackups 需要先挂载备份设备才能看到 snapshotsRoot 里的内容，
+// 因此临时打开/挂载备份分区，读完就卸载，不占用 BackingUp/Restoring 状态。
+func (m *Manager) ListBackups() (infos []BackupInfo, busErr *dbus.Error) {
+	cfg := m.cfg()
+	err := m.withBackupDevice(cfg, func() error {
+		var err error
+		infos, err = listSnapshots(retentionPrefix(cfg.Retention))
+		return err
+	})
+	return infos, dbusutil.ToError(err)
+}
+
+func (m *Manager) RestoreBackup(id string) *dbus.Error {
+	err := m.startRestore(nil, id)
+	return dbusutil.ToError(err)
+}
+
+// PruneBackups 和 ListBackups 一样，需要先挂载备份设备才能访问 snapshotsRoot。
+func (m *Manager) PruneBackups(dryRun bool) (pruned []BackupInfo, busErr *dbus.Error) {
+	cfg := m.cfg()
+	err := m.withBackupDevice(cfg, func() error {
+		var err error
+		pruned, err = pruneSnapshots(cfg, dryRun)
+		return err
+	})
+	return pruned, dbusutil.ToError(err)
+}
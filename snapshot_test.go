@@ -0,0 +1,107 @@
+// SPDX-FileCopyrightText: 2018 - 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withTempSnapshotsRoot 把 snapshotsRoot 临时指向一个空目录，让 pruneSnapshots 可以在
+// 不依赖真实 btrfs 设备的情况下测试它的保留策略；dryRun 场景下 pruneSnapshots 只读目录，
+// 从不调用 removeSnapshot（也就不会执行 btrfs 命令）。
+func withTempSnapshotsRoot(t *testing.T) {
+	t.Helper()
+	old := snapshotsRoot
+	snapshotsRoot = t.TempDir()
+	t.Cleanup(func() { snapshotsRoot = old })
+}
+
+func makeSnapshotDir(t *testing.T, prefix string, age time.Duration) BackupInfo {
+	t.Helper()
+	id := time.Now().Add(-age).UTC().Format(time.RFC3339)
+	if err := os.MkdirAll(filepath.Join(snapshotsRoot, prefix+id), 0755); err != nil {
+		t.Fatalf("mkdir snapshot dir: %v", err)
+	}
+	return BackupInfo{Id: id, Time: time.Now().Add(-age).Unix()}
+}
+
+func TestPruneSnapshotsByCount(t *testing.T) {
+	withTempSnapshotsRoot(t)
+	const prefix = "ab-recovery-"
+
+	makeSnapshotDir(t, prefix, 0)
+	makeSnapshotDir(t, prefix, time.Minute)
+	makeSnapshotDir(t, prefix, 2*time.Minute)
+
+	cfg := &Config{Retention: Retention{Count: 2, Prefix: prefix}}
+	toRemove, err := pruneSnapshots(cfg, true)
+	if err != nil {
+		t.Fatalf("pruneSnapshots: %v", err)
+	}
+	if len(toRemove) != 1 {
+		t.Fatalf("expected 1 snapshot to prune, got %d: %v", len(toRemove), toRemove)
+	}
+
+	remaining, err := listSnapshots(prefix)
+	if err != nil {
+		t.Fatalf("listSnapshots: %v", err)
+	}
+	if len(remaining) != 3 {
+		t.Fatalf("dry run must not remove anything, listSnapshots returned %d entries", len(remaining))
+	}
+}
+
+func TestPruneSnapshotsByMaxAge(t *testing.T) {
+	withTempSnapshotsRoot(t)
+	const prefix = "ab-recovery-"
+
+	makeSnapshotDir(t, prefix, 0)
+	old := makeSnapshotDir(t, prefix, 48*time.Hour)
+
+	cfg := &Config{Retention: Retention{MaxAge: time.Hour, Prefix: prefix}}
+	toRemove, err := pruneSnapshots(cfg, true)
+	if err != nil {
+		t.Fatalf("pruneSnapshots: %v", err)
+	}
+	if len(toRemove) != 1 || toRemove[0].Id != old.Id {
+		t.Fatalf("expected only the stale snapshot %q to be pruned, got %v", old.Id, toRemove)
+	}
+}
+
+func TestPruneSnapshotsAlwaysKeepsNewest(t *testing.T) {
+	withTempSnapshotsRoot(t)
+	const prefix = "ab-recovery-"
+
+	makeSnapshotDir(t, prefix, 48*time.Hour)
+
+	cfg := &Config{Retention: Retention{Count: 1, MaxAge: time.Minute, Prefix: prefix}}
+	toRemove, err := pruneSnapshots(cfg, true)
+	if err != nil {
+		t.Fatalf("pruneSnapshots: %v", err)
+	}
+	if len(toRemove) != 0 {
+		t.Fatalf("the single newest snapshot must never be pruned, got %v", toRemove)
+	}
+}
+
+func TestPruneSnapshotsNoRetentionConfigured(t *testing.T) {
+	withTempSnapshotsRoot(t)
+	const prefix = "ab-recovery-"
+
+	makeSnapshotDir(t, prefix, 0)
+	makeSnapshotDir(t, prefix, 48*time.Hour)
+
+	cfg := &Config{Retention: Retention{Prefix: prefix}}
+	toRemove, err := pruneSnapshots(cfg, true)
+	if err != nil {
+		t.Fatalf("pruneSnapshots: %v", err)
+	}
+	if len(toRemove) != 0 {
+		t.Fatalf("expected nothing pruned with no Count/MaxAge set, got %v", toRemove)
+	}
+}